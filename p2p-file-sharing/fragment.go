@@ -3,11 +3,17 @@
 package main
 
 import (
+    "archive/tar"
+    "bytes"
+    "compress/gzip"
     "crypto/sha256"
+    "encoding/hex"
     "fmt"
     "io"
     "os"
+    "path/filepath"
     "sort"
+    "strings"
 )
 
 // Fragment representa un fragmento de archivo
@@ -29,46 +35,312 @@ func NewFragmentManager(fragmentSize int) *FragmentManager {
     return &FragmentManager{FragmentSize: fragmentSize}
 }
 
-// FragmentFile divide un archivo en fragmentos
-func (fm *FragmentManager) FragmentFile(filepath string) ([]Fragment, error) {
-    file, err := os.Open(filepath)
+// ManifestEntry describe una entrada del manifiesto tar de un directorio empaquetado
+type ManifestEntry struct {
+    Path string
+    Mode int64
+    Size int64
+}
+
+// FragmentCallback recibe cada fragmento tan pronto se produce, para que quien
+// fragmenta (normalmente Store.Put) pueda consumirlo sin que FragmentManager
+// tenga que retener los bytes de todo el archivo en memoria
+type FragmentCallback func(Fragment) error
+
+// FragmentFile divide un archivo regular en fragmentos, leyéndolo en streaming
+// e invocando onFragment con cada uno en cuanto se produce en vez de
+// acumularlos en memoria, para que subir archivos de varios GB no agote la
+// memoria del nodo. Devuelve los hashes en orden
+func (fm *FragmentManager) FragmentFile(path string, onFragment FragmentCallback) ([]string, error) {
+    file, err := os.Open(path)
     if err != nil {
         return nil, fmt.Errorf("error leyendo archivo: %v", err)
     }
     defer file.Close()
 
-    data, err := io.ReadAll(file)
+    hashes, err := fm.streamFragments(file, path, onFragment)
+    if err != nil {
+        return nil, err
+    }
+    if len(hashes) == 0 {
+        return nil, fmt.Errorf("el archivo %s está vacío", path)
+    }
+    return hashes, nil
+}
+
+// FragmentPath fragmenta un archivo o un directorio, invocando onFragment con
+// cada fragmento en cuanto se produce. Los directorios se empaquetan en
+// streaming como tar+gzip y su manifiesto se guarda en FileInfo.Manifest para
+// poder reconstruir la estructura de carpetas al ensamblar
+func (fm *FragmentManager) FragmentPath(path string, onFragment FragmentCallback) ([]string, FileInfo, error) {
+    info, err := os.Stat(path)
+    if err != nil {
+        return nil, FileInfo{}, fmt.Errorf("error leyendo ruta %s: %v", path, err)
+    }
+
+    if info.IsDir() {
+        return fm.fragmentDirectory(path, onFragment)
+    }
+
+    hashes, err := fm.FragmentFile(path, onFragment)
     if err != nil {
-        return nil, fmt.Errorf("error leyendo datos: %v", err)
+        return nil, FileInfo{}, err
+    }
+    return hashes, fileInfoFor(path, hashes, nil), nil
+}
+
+// fragmentDirectory empaqueta path como tar+gzip en streaming, a través de un
+// io.Pipe, y fragmenta el flujo comprimido resultante invocando onFragment con
+// cada fragmento sin materializar el directorio completo en memoria
+func (fm *FragmentManager) fragmentDirectory(path string, onFragment FragmentCallback) ([]string, FileInfo, error) {
+    pr, pw := io.Pipe()
+    manifestCh := make(chan []ManifestEntry, 1)
+    packErrCh := make(chan error, 1)
+
+    go func() {
+        gw := gzip.NewWriter(pw)
+        tw := tar.NewWriter(gw)
+
+        manifest, err := packDirectory(tw, path)
+        if err != nil {
+            pw.CloseWithError(err)
+            packErrCh <- err
+            return
+        }
+        if err := tw.Close(); err != nil {
+            pw.CloseWithError(err)
+            packErrCh <- err
+            return
+        }
+        if err := gw.Close(); err != nil {
+            pw.CloseWithError(err)
+            packErrCh <- err
+            return
+        }
+        manifestCh <- manifest
+        pw.Close()
+    }()
+
+    hashes, err := fm.streamFragments(pr, path, onFragment)
+    if err != nil {
+        // Cerrar el extremo de lectura con el error hace que la siguiente
+        // escritura de la goroutine de empaquetado falle, para que no se
+        // quede bloqueada para siempre escribiendo en un pipe que nadie lee
+        pr.CloseWithError(err)
+        return nil, FileInfo{}, fmt.Errorf("error empaquetando directorio %s: %v", path, err)
+    }
+    select {
+    case err := <-packErrCh:
+        return nil, FileInfo{}, fmt.Errorf("error empaquetando directorio %s: %v", path, err)
+    default:
+    }
+    if len(hashes) == 0 {
+        return nil, FileInfo{}, fmt.Errorf("el directorio %s está vacío", path)
     }
 
-    filename := filepath
-    totalFragments := (len(data) + fm.FragmentSize - 1) / fm.FragmentSize
-    fragments := make([]Fragment, 0, totalFragments)
+    manifest := <-manifestCh
+    return hashes, fileInfoFor(path, hashes, manifest), nil
+}
+
+// packDirectory recorre root y escribe cada entrada en tw, devolviendo el manifiesto resultante
+func packDirectory(tw *tar.Writer, root string) ([]ManifestEntry, error) {
+    var manifest []ManifestEntry
+
+    err := filepath.Walk(root, func(file string, fi os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+
+        relPath, err := filepath.Rel(root, file)
+        if err != nil {
+            return fmt.Errorf("error calculando ruta relativa de %s: %v", file, err)
+        }
+        if relPath == "." {
+            return nil
+        }
 
-    for i := 0; i < totalFragments; i++ {
-        start := i * fm.FragmentSize
-        end := start + fm.FragmentSize
-        if end > len(data) {
-            end = len(data)
+        header, err := tar.FileInfoHeader(fi, "")
+        if err != nil {
+            return fmt.Errorf("error generando cabecera tar para %s: %v", file, err)
         }
-        fragmentData := data[start:end]
-        hash := fmt.Sprintf("%x", sha256.Sum256(fragmentData))
+        header.Name = filepath.ToSlash(relPath)
 
-        fragment := Fragment{
-            Hash:          hash,
-            Data:          fragmentData,
-            Index:         i,
-            TotalFragments: totalFragments,
-            Filename:      filename,
+        if err := tw.WriteHeader(header); err != nil {
+            return fmt.Errorf("error escribiendo cabecera tar para %s: %v", file, err)
         }
-        fragments = append(fragments, fragment)
+
+        if !fi.IsDir() {
+            f, err := os.Open(file)
+            if err != nil {
+                return fmt.Errorf("error abriendo %s: %v", file, err)
+            }
+            defer f.Close()
+            if _, err := io.Copy(tw, f); err != nil {
+                return fmt.Errorf("error empaquetando %s: %v", file, err)
+            }
+        }
+
+        manifest = append(manifest, ManifestEntry{Path: header.Name, Mode: header.Mode, Size: fi.Size()})
+        return nil
+    })
+    if err != nil {
+        return nil, err
     }
-    return fragments, nil
+    return manifest, nil
 }
 
-// AssembleFile ensambla fragmentos en un archivo
-func (fm *FragmentManager) AssembleFile(fragments []Fragment, outputPath string) error {
+// streamFragments lee r en bloques de FragmentSize, invoca onFragment con
+// cada uno en cuanto se produce y solo retiene su hash para el resultado, sin
+// necesitar conocer de antemano el tamaño total del flujo ni mantener los
+// bytes de fragmentos ya procesados en memoria
+func (fm *FragmentManager) streamFragments(r io.Reader, filename string, onFragment FragmentCallback) ([]string, error) {
+    var hashes []string
+    buf := make([]byte, fm.FragmentSize)
+
+    for i := 0; ; i++ {
+        n, err := io.ReadFull(r, buf)
+        if n > 0 {
+            chunk := make([]byte, n)
+            copy(chunk, buf[:n])
+            fragment := Fragment{
+                Hash:     fmt.Sprintf("%x", sha256.Sum256(chunk)),
+                Data:     chunk,
+                Index:    i,
+                Filename: filename,
+            }
+            if onFragment != nil {
+                if err := onFragment(fragment); err != nil {
+                    return nil, fmt.Errorf("error procesando fragmento %d de %s: %v", i, filename, err)
+                }
+            }
+            hashes = append(hashes, fragment.Hash)
+        }
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+            break
+        }
+        if err != nil {
+            return nil, fmt.Errorf("error leyendo datos: %v", err)
+        }
+    }
+
+    return hashes, nil
+}
+
+// fileInfoFor construye el FileInfo a partir de los hashes de fragmento ya generados
+func fileInfoFor(path string, hashes []string, manifest []ManifestEntry) FileInfo {
+    return FileInfo{
+        Filename:       path,
+        FragmentHashes: hashes,
+        TotalFragments: len(hashes),
+        Manifest:       manifest,
+    }
+}
+
+// BuildMerkleTree construye un árbol de Merkle binario sobre los hashes de fragmento
+// (convención de duplicar el último nodo en los niveles con cantidad impar) y
+// devuelve la raíz en hexadecimal junto con todos los niveles del árbol, que se
+// usan después para generar la prueba de inclusión de cada fragmento
+func (fm *FragmentManager) BuildMerkleTree(fragmentHashes []string) (root string, levels [][]string, err error) {
+    if len(fragmentHashes) == 0 {
+        return "", nil, fmt.Errorf("no hay hashes de fragmento para construir el árbol de Merkle")
+    }
+
+    level := make([]string, len(fragmentHashes))
+    copy(level, fragmentHashes)
+    levels = append(levels, level)
+
+    for len(level) > 1 {
+        next := make([]string, 0, (len(level)+1)/2)
+        for i := 0; i < len(level); i += 2 {
+            left := level[i]
+            right := left
+            if i+1 < len(level) {
+                right = level[i+1]
+            }
+            next = append(next, merkleHashPair(left, right))
+        }
+        levels = append(levels, next)
+        level = next
+    }
+
+    return level[0], levels, nil
+}
+
+// MerkleProof genera la prueba de inclusión (hashes hermanos, de abajo a arriba)
+// del fragmento en la posición index del árbol descrito por levels
+func MerkleProof(levels [][]string, index int) ([][]byte, error) {
+    if len(levels) == 0 {
+        return nil, fmt.Errorf("árbol de Merkle vacío")
+    }
+    if index < 0 || index >= len(levels[0]) {
+        return nil, fmt.Errorf("índice de fragmento fuera de rango: %d", index)
+    }
+
+    proof := make([][]byte, 0, len(levels)-1)
+    idx := index
+    for _, level := range levels[:len(levels)-1] {
+        siblingIdx := idx ^ 1
+        if siblingIdx >= len(level) {
+            siblingIdx = idx // nivel impar: el último nodo se duplica a sí mismo
+        }
+        sibling, err := hex.DecodeString(level[siblingIdx])
+        if err != nil {
+            return nil, fmt.Errorf("error decodificando nodo del árbol: %v", err)
+        }
+        proof = append(proof, sibling)
+        idx /= 2
+    }
+    return proof, nil
+}
+
+// VerifyFragment recalcula el hash hoja de un fragmento y recorre la prueba de
+// inclusión para comprobar que coincide con root. Esto permite a quien descarga
+// un archivo confiar en FileInfo comprobando solo la raíz, sin tener que confiar
+// en cada peer que le sirve un fragmento
+func (fm *FragmentManager) VerifyFragment(data []byte, index, total int, proof [][]byte, root string) error {
+    if index < 0 || index >= total {
+        return fmt.Errorf("índice de fragmento fuera de rango: %d/%d", index, total)
+    }
+
+    leaf := sha256.Sum256(data)
+    current := leaf[:]
+
+    idx := index
+    for _, sibling := range proof {
+        h := sha256.New()
+        if idx%2 == 0 {
+            h.Write(current)
+            h.Write(sibling)
+        } else {
+            h.Write(sibling)
+            h.Write(current)
+        }
+        sum := h.Sum(nil)
+        current = sum
+        idx /= 2
+    }
+
+    got := fmt.Sprintf("%x", current)
+    if got != root {
+        return fmt.Errorf("prueba de Merkle inválida para el fragmento %d: esperado %s, obtenido %s", index, root, got)
+    }
+    return nil
+}
+
+// merkleHashPair calcula el hash SHA-256 de la concatenación de dos nodos del árbol de Merkle
+func merkleHashPair(left, right string) string {
+    l, _ := hex.DecodeString(left)
+    r, _ := hex.DecodeString(right)
+    h := sha256.New()
+    h.Write(l)
+    h.Write(r)
+    return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// AssembleFile ensambla fragmentos en un archivo. Si manifest no está vacío,
+// los fragmentos contienen un flujo tar+gzip que se desempaqueta en outputPath
+// como un directorio en vez de escribirse como un único archivo
+func (fm *FragmentManager) AssembleFile(fragments []Fragment, manifest []ManifestEntry, outputPath string) error {
     if len(fragments) == 0 {
         return fmt.Errorf("no hay fragmentos para ensamblar")
     }
@@ -83,6 +355,10 @@ func (fm *FragmentManager) AssembleFile(fragments []Fragment, outputPath string)
         return fmt.Errorf("fragmentos incompletos: %d/%d", len(fragments), fragments[0].TotalFragments)
     }
 
+    if len(manifest) > 0 {
+        return extractDirectory(fragments, outputPath)
+    }
+
     // Ensamblar
     outputFile, err := os.Create(outputPath)
     if err != nil {
@@ -96,4 +372,79 @@ func (fm *FragmentManager) AssembleFile(fragments []Fragment, outputPath string)
         }
     }
     return nil
+}
+
+// extractDirectory reconstruye un directorio a partir de un flujo tar+gzip
+// repartido en fragmentos ya ordenados, vía tar.NewReader(gzip.NewReader(...))
+func extractDirectory(fragments []Fragment, outputPath string) error {
+    if err := os.MkdirAll(outputPath, 0o755); err != nil {
+        return fmt.Errorf("error creando directorio %s: %v", outputPath, err)
+    }
+
+    readers := make([]io.Reader, len(fragments))
+    for i, fragment := range fragments {
+        readers[i] = bytes.NewReader(fragment.Data)
+    }
+
+    gzr, err := gzip.NewReader(io.MultiReader(readers...))
+    if err != nil {
+        return fmt.Errorf("error leyendo flujo gzip: %v", err)
+    }
+    defer gzr.Close()
+
+    tr := tar.NewReader(gzr)
+    for {
+        header, err := tr.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return fmt.Errorf("error leyendo entrada tar: %v", err)
+        }
+
+        target, err := safeExtractPath(outputPath, header.Name)
+        if err != nil {
+            return err
+        }
+        switch header.Typeflag {
+        case tar.TypeSymlink, tar.TypeLink:
+            return fmt.Errorf("entrada tar rechazada, los enlaces no están permitidos: %s", header.Name)
+        case tar.TypeDir:
+            if err := os.MkdirAll(target, os.FileMode(header.Mode)); err != nil {
+                return fmt.Errorf("error creando directorio %s: %v", target, err)
+            }
+        case tar.TypeReg:
+            if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+                return fmt.Errorf("error creando directorio %s: %v", filepath.Dir(target), err)
+            }
+            f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode))
+            if err != nil {
+                return fmt.Errorf("error creando archivo %s: %v", target, err)
+            }
+            if _, err := io.Copy(f, tr); err != nil {
+                f.Close()
+                return fmt.Errorf("error escribiendo %s: %v", target, err)
+            }
+            f.Close()
+        }
+    }
+    return nil
+}
+
+// safeExtractPath resuelve la ruta destino de una entrada tar dentro de
+// outputPath y rechaza cualquier entry.Name que, una vez limpiado, intente
+// escapar de outputPath (p. ej. "../../.ssh/authorized_keys" o una ruta
+// absoluta), evitando que un tar malicioso escriba fuera del directorio de salida
+func safeExtractPath(outputPath, name string) (string, error) {
+    cleaned := filepath.Clean(filepath.FromSlash(name))
+    if filepath.IsAbs(cleaned) {
+        return "", fmt.Errorf("entrada tar fuera del directorio de salida: %s", name)
+    }
+    target := filepath.Join(outputPath, cleaned)
+
+    rel, err := filepath.Rel(outputPath, target)
+    if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+        return "", fmt.Errorf("entrada tar fuera del directorio de salida: %s", name)
+    }
+    return target, nil
 }
\ No newline at end of file
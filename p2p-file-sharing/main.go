@@ -3,11 +3,12 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
-	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ipfs/go-cid"
@@ -22,11 +23,65 @@ import (
 
 // P2PNode representa un nodo en la red P2P
 type P2PNode struct {
-	Host            host.Host
-	DHT             *dht.IpfsDHT
-	FragmentMgr     *FragmentManager
-	StoredFragments map[string]Fragment
-	FileMetadata    map[string]FileInfo
+	Host                host.Host
+	DHT                 *dht.IpfsDHT
+	FragmentMgr         *FragmentManager
+	Store               FragmentStore
+	DownloadParallelism int
+	Search              *SearchManager
+	Transfer            *TransferManager
+
+	// metaMu protege FragmentIndex y FileMetadata, que handleFragmentRequest
+	// lee en su propia goroutine por stream mientras UploadFile/DownloadFile
+	// los escriben y SearchManager.handleQuery los recorre desde el bucle de
+	// lectura de gossipsub
+	metaMu        sync.RWMutex
+	FragmentIndex map[string]FragmentMeta
+	FileMetadata  map[string]FileInfo
+}
+
+// fragmentMeta devuelve los metadatos indexados de un fragmento, si existen
+func (n *P2PNode) fragmentMeta(hash string) (FragmentMeta, bool) {
+	n.metaMu.RLock()
+	defer n.metaMu.RUnlock()
+	meta, ok := n.FragmentIndex[hash]
+	return meta, ok
+}
+
+// fileInfo devuelve los metadatos de un archivo conocido localmente, si existen
+func (n *P2PNode) fileInfo(filename string) (FileInfo, bool) {
+	n.metaMu.RLock()
+	defer n.metaMu.RUnlock()
+	info, ok := n.FileMetadata[filename]
+	return info, ok
+}
+
+// setFragmentMeta registra los metadatos de un fragmento recién almacenado
+func (n *P2PNode) setFragmentMeta(hash string, meta FragmentMeta) {
+	n.metaMu.Lock()
+	defer n.metaMu.Unlock()
+	n.FragmentIndex[hash] = meta
+}
+
+// setFileInfo registra los metadatos de un archivo recién subido o descargado
+func (n *P2PNode) setFileInfo(filename string, info FileInfo) {
+	n.metaMu.Lock()
+	defer n.metaMu.Unlock()
+	n.FileMetadata[filename] = info
+}
+
+// matchingFiles devuelve los FileInfo cuyo nombre contiene substring
+func (n *P2PNode) matchingFiles(substring string) []FileInfo {
+	n.metaMu.RLock()
+	defer n.metaMu.RUnlock()
+
+	var matches []FileInfo
+	for name, info := range n.FileMetadata {
+		if strings.Contains(name, substring) {
+			matches = append(matches, info)
+		}
+	}
+	return matches
 }
 
 // FileInfo contiene metadatos del archivo
@@ -34,6 +89,8 @@ type FileInfo struct {
 	Filename       string
 	FragmentHashes []string
 	TotalFragments int
+	MerkleRoot     string
+	Manifest       []ManifestEntry
 }
 
 // FragmentRequest representa una solicitud de fragmento
@@ -43,13 +100,14 @@ type FragmentRequest struct {
 
 // FragmentResponse representa la respuesta de un fragmento
 type FragmentResponse struct {
-	Hash  string `json:"hash"`
-	Data  []byte `json:"data"`
-	Found bool   `json:"found"`
+	Hash  string   `json:"hash"`
+	Data  []byte   `json:"data"`
+	Found bool     `json:"found"`
+	Proof [][]byte `json:"proof"`
 }
 
-// NewP2PNode crea un nuevo nodo P2P
-func NewP2PNode(port int, bootstrapAddrs []string) (*P2PNode, error) {
+// NewP2PNode crea un nuevo nodo P2P que almacena sus fragmentos en store
+func NewP2PNode(port int, bootstrapAddrs []string, store FragmentStore) (*P2PNode, error) {
 	ctx := context.Background()
 
 	// Crear nodo libp2p
@@ -94,19 +152,45 @@ func NewP2PNode(port int, bootstrapAddrs []string) (*P2PNode, error) {
 
 	// Crear nodo
 	p2pNode := &P2PNode{
-		Host:            node,
-		DHT:             kademliaDHT,
-		FragmentMgr:     NewFragmentManager(256 * 1024), // 256KB por fragmento
-		StoredFragments: make(map[string]Fragment),
-		FileMetadata:    make(map[string]FileInfo),
+		Host:                node,
+		DHT:                 kademliaDHT,
+		FragmentMgr:         NewFragmentManager(256 * 1024), // 256KB por fragmento
+		Store:               store,
+		FragmentIndex:       make(map[string]FragmentMeta),
+		FileMetadata:        make(map[string]FileInfo),
+		DownloadParallelism: 4,
 	}
 
+	// El TransferManager vive mientras viva el nodo, para que su deduplicación
+	// de descargas en curso se comparta entre llamadas a DownloadFile en vez de
+	// reiniciarse en cada una; los fallos y el blacklist de peers se llevan por
+	// separado en cada llamada y se borran al terminarla
+	p2pNode.Transfer = NewTransferManager(p2pNode, p2pNode.DownloadParallelism)
+
 	// Configurar handler para fragmentos
 	node.SetStreamHandler("/fragment/1.0.0", p2pNode.handleFragmentRequest)
 
+	// Lanzar el bucle de reprovide en segundo plano
+	reprovider := NewReprovideManager(p2pNode, defaultReprovideInterval, defaultProvideWorkers)
+	go reprovider.Run(ctx)
+
+	// Unirse al topic de búsqueda de archivos
+	searchMgr, err := NewSearchManager(ctx, p2pNode)
+	if err != nil {
+		node.Close()
+		return nil, fmt.Errorf("error iniciando búsqueda: %v", err)
+	}
+	p2pNode.Search = searchMgr
+
 	return p2pNode, nil
 }
 
+// SearchFiles busca en la red archivos cuyo nombre contenga query, agregando
+// las respuestas recibidas durante timeout
+func (n *P2PNode) SearchFiles(ctx context.Context, query string, timeout time.Duration) ([]FileInfo, error) {
+	return n.Search.SearchFiles(ctx, query, timeout)
+}
+
 // handleFragmentRequest maneja solicitudes de fragmentos
 func (n *P2PNode) handleFragmentRequest(s network.Stream) {
 	defer s.Close()
@@ -125,9 +209,36 @@ func (n *P2PNode) handleFragmentRequest(s network.Stream) {
 		Found: false,
 	}
 
-	if fragment, exists := n.StoredFragments[req.Hash]; exists {
-		response.Data = fragment.Data
+	// req.Hash viene de un peer remoto sin validar: rechazarlo aquí antes de
+	// que llegue al almacén evita que un hash malicioso como
+	// "../../../../etc/passwd" se use para construir una ruta de archivo
+	if !validFragmentHash(req.Hash) {
+		log.Printf("Solicitud de fragmento con hash inválido: %q", req.Hash)
+		encoder := json.NewEncoder(s)
+		if err := encoder.Encode(response); err != nil {
+			log.Printf("Error enviando respuesta: %v", err)
+		}
+		return
+	}
+
+	if data, exists, err := n.Store.Get(req.Hash); err != nil {
+		log.Printf("Error leyendo fragmento %s del almacén: %v", req.Hash, err)
+	} else if exists {
+		response.Data = data
 		response.Found = true
+
+		if meta, ok := n.fragmentMeta(req.Hash); ok {
+			if fileInfo, ok := n.fileInfo(meta.Filename); ok {
+				_, levels, err := n.FragmentMgr.BuildMerkleTree(fileInfo.FragmentHashes)
+				if err != nil {
+					log.Printf("Error construyendo árbol de Merkle para %s: %v", meta.Filename, err)
+				} else if proof, err := MerkleProof(levels, meta.Index); err != nil {
+					log.Printf("Error generando prueba de Merkle para fragmento %s: %v", req.Hash, err)
+				} else {
+					response.Proof = proof
+				}
+			}
+		}
 	}
 
 	// Enviar respuesta
@@ -137,30 +248,46 @@ func (n *P2PNode) handleFragmentRequest(s network.Stream) {
 	}
 }
 
-// UploadFile sube un archivo a la red
+// UploadFile sube un archivo o directorio a la red
 func (n *P2PNode) UploadFile(filepath string) error {
 	ctx := context.Background()
-	fragments, err := n.FragmentMgr.FragmentFile(filepath)
+
+	// Cada fragmento se escribe en el almacén en cuanto FragmentMgr lo
+	// produce, en vez de esperar a tener el archivo completo fragmentado en
+	// memoria, para que subir archivos de varios GB no agote la memoria del nodo
+	storeFragment := func(fragment Fragment) error {
+		return n.Store.Put(fragment.Hash, fragment.Data)
+	}
+
+	fragmentHashes, fileInfo, err := n.FragmentMgr.FragmentPath(filepath, storeFragment)
 	if err != nil {
 		return err
 	}
 
-	filename := filepath
-	fragmentHashes := make([]string, len(fragments))
+	filename := fileInfo.Filename
 
-	// Almacenar fragmentos localmente
-	for i, fragment := range fragments {
-		fragmentHashes[i] = fragment.Hash
-		n.StoredFragments[fragment.Hash] = fragment
+	for i, hash := range fragmentHashes {
+		n.setFragmentMeta(hash, FragmentMeta{
+			Index:          i,
+			TotalFragments: len(fragmentHashes),
+			Filename:       filename,
+		})
 	}
 
-	// Almacenar metadatos del archivo localmente y en la DHT
-	fileInfo := FileInfo{
-		Filename:       filename,
-		FragmentHashes: fragmentHashes,
-		TotalFragments: len(fragments),
+	// Anunciar cada fragmento como proveedor en la DHT para que el resto de la
+	// red pueda encontrarlos sin depender de que este nodo siga activo
+	n.provideFragments(ctx, fragmentHashes, defaultProvideWorkers)
+
+	// Construir el árbol de Merkle sobre los hashes de fragmento para que quien
+	// descargue el archivo pueda confiar en FileInfo comprobando solo la raíz
+	merkleRoot, _, err := n.FragmentMgr.BuildMerkleTree(fragmentHashes)
+	if err != nil {
+		return fmt.Errorf("error construyendo árbol de Merkle: %v", err)
 	}
-	n.FileMetadata[filename] = fileInfo
+	fileInfo.MerkleRoot = merkleRoot
+
+	// Almacenar metadatos del archivo localmente y en la DHT
+	n.setFileInfo(filename, fileInfo)
 
 	fileInfoBytes, err := json.Marshal(fileInfo)
 	if err != nil {
@@ -177,21 +304,100 @@ func (n *P2PNode) UploadFile(filepath string) error {
 		return fmt.Errorf("error almacenando metadatos del archivo: %v", err)
 	}
 
-	log.Printf("Archivo %s subido con %d fragmentos", filename, len(fragments))
+	log.Printf("Archivo %s subido con %d fragmentos", filename, len(fragmentHashes))
+	return nil
+}
+
+// DownloadFile localiza los metadatos de un archivo en la DHT, descarga sus
+// fragmentos en paralelo a través del TransferManager y los ensambla en outputPath
+func (n *P2PNode) DownloadFile(filename, outputPath string) error {
+	ctx := context.Background()
+
+	hash, err := mh.Sum([]byte(filename), mh.SHA2_256, -1)
+	if err != nil {
+		return fmt.Errorf("error generando hash para archivo %s: %v", filename, err)
+	}
+	fileCid := cid.NewCidV1(cid.Raw, hash)
+
+	raw, err := n.DHT.GetValue(ctx, fileCid.String())
+	if err != nil {
+		return fmt.Errorf("error obteniendo metadatos del archivo: %v", err)
+	}
+
+	var fileInfo FileInfo
+	if err := json.Unmarshal(raw, &fileInfo); err != nil {
+		return fmt.Errorf("error decodificando metadatos del archivo: %v", err)
+	}
+
+	progressCh := make(chan ProgressEvent, 1)
+	go func() {
+		for ev := range progressCh {
+			log.Printf("Descargando %s: %d/%d fragmentos (%d bytes)", ev.Filename, ev.FragmentsDone, ev.FragmentsTotal, ev.BytesDone)
+		}
+	}()
+
+	fragments, err := n.Transfer.FetchFile(ctx, fileInfo, progressCh)
+	close(progressCh)
+	if err != nil {
+		return fmt.Errorf("error descargando fragmentos: %v", err)
+	}
+
+	downloadedHashes := make([]string, len(fragments))
+	for i, fragment := range fragments {
+		if err := n.Store.Put(fragment.Hash, fragment.Data); err != nil {
+			return fmt.Errorf("error almacenando fragmento %s: %v", fragment.Hash, err)
+		}
+		n.setFragmentMeta(fragment.Hash, FragmentMeta{
+			Index:          fragment.Index,
+			TotalFragments: fragment.TotalFragments,
+			Filename:       fragment.Filename,
+		})
+		downloadedHashes[i] = fragment.Hash
+	}
+	n.setFileInfo(filename, fileInfo)
+
+	// Anunciarnos como proveedores de los fragmentos que acabamos de descargar,
+	// para seguir sembrando el archivo como parte del swarm
+	n.provideFragments(ctx, downloadedHashes, defaultProvideWorkers)
+
+	if err := n.FragmentMgr.AssembleFile(fragments, fileInfo.Manifest, outputPath); err != nil {
+		return err
+	}
+
+	log.Printf("Archivo %s descargado y ensamblado en %s", filename, outputPath)
 	return nil
 }
 
 func main() {
-	if len(os.Args) < 4 {
-		log.Fatal("Uso: go run main.go fragment.go <puerto> upload <archivo> [bootstrap]")
+	storeFlag := flag.String("store", "memory", "backend de almacenamiento de fragmentos: memory, disk o mmap")
+	dataDirFlag := flag.String("data-dir", "./data", "directorio de datos para los backends disk y mmap")
+	cacheCapacityFlag := flag.Int("cache-capacity", 0, "máximo de fragmentos en caché para el backend memory (0 = sin límite)")
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) < 3 {
+		log.Fatal("Uso: go run . [--store memory|disk|mmap] [--data-dir dir] [--cache-capacity n] <puerto> upload|download|search <archivo|consulta> [salida] [bootstrap]")
+	}
+
+	portStr := args[0]
+	command := args[1]
+	filename := args[2]
+
+	// download necesita una ruta de salida como cuarto argumento; el resto de
+	// comandos usan ese hueco para la lista de bootstrap
+	outputPath := filename
+	bootstrapIndex := 3
+	if command == "download" {
+		if len(args) < 4 {
+			log.Fatal("Uso: go run . download <archivo> <salida> [bootstrap]")
+		}
+		outputPath = args[3]
+		bootstrapIndex = 4
 	}
 
-	portStr := os.Args[1]
-	command := os.Args[2]
-	filename := os.Args[3]
 	bootstrapAddrs := []string{}
-	if len(os.Args) > 4 {
-		bootstrapAddrs = strings.Split(os.Args[4], ",")
+	if len(args) > bootstrapIndex {
+		bootstrapAddrs = strings.Split(args[bootstrapIndex], ",")
 	}
 
 	// Convertir puerto a entero
@@ -200,8 +406,13 @@ func main() {
 		log.Fatalf("Puerto inválido: %v", err)
 	}
 
+	store, err := newFragmentStore(*storeFlag, *dataDirFlag, *cacheCapacityFlag)
+	if err != nil {
+		log.Fatalf("Error creando almacén de fragmentos: %v", err)
+	}
+
 	// Crear nodo
-	node, err := NewP2PNode(port, bootstrapAddrs)
+	node, err := NewP2PNode(port, bootstrapAddrs, store)
 	if err != nil {
 		log.Fatalf("Error creando nodo: %v", err)
 	}
@@ -224,7 +435,21 @@ func main() {
 		// Mantener el nodo corriendo para servir el archivo
 		log.Println("Manteniendo nodo activo para servir archivos...")
 		select {}
+	} else if command == "download" {
+		err = node.DownloadFile(filename, outputPath)
+		if err != nil {
+			log.Fatalf("Error descargando archivo: %v", err)
+		}
+		log.Println("Archivo descargado exitosamente")
+	} else if command == "search" {
+		results, err := node.SearchFiles(context.Background(), filename, 5*time.Second)
+		if err != nil {
+			log.Fatalf("Error buscando archivos: %v", err)
+		}
+		for _, info := range results {
+			log.Printf("Encontrado: %s (%d fragmentos)", info.Filename, info.TotalFragments)
+		}
 	} else {
-		log.Fatal("Comando desconocido: use 'upload'")
+		log.Fatal("Comando desconocido: use 'upload', 'download' o 'search'")
 	}
 }
\ No newline at end of file
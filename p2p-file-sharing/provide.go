@@ -0,0 +1,100 @@
+//provide.go
+
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+)
+
+const (
+    // defaultReprovideInterval es cada cuánto se reanuncian los fragmentos alojados
+    defaultReprovideInterval = 12 * time.Hour
+    // defaultProvideWorkers acota cuántas llamadas Provide concurrentes se lanzan a la vez
+    defaultProvideWorkers = 8
+)
+
+// ReprovideManager reanuncia periódicamente en la DHT los fragmentos que el
+// nodo tiene almacenados, para que sigan siendo localizables aunque el peer
+// que los subió originalmente esté desconectado
+type ReprovideManager struct {
+    node     *P2PNode
+    interval time.Duration
+    workers  int
+}
+
+// NewReprovideManager crea un gestor de reprovide con el intervalo y paralelismo indicados
+func NewReprovideManager(node *P2PNode, interval time.Duration, workers int) *ReprovideManager {
+    if interval <= 0 {
+        interval = defaultReprovideInterval
+    }
+    if workers <= 0 {
+        workers = defaultProvideWorkers
+    }
+    return &ReprovideManager{node: node, interval: interval, workers: workers}
+}
+
+// Run ejecuta el bucle de reprovide hasta que ctx se cancele
+func (rm *ReprovideManager) Run(ctx context.Context) {
+    ticker := time.NewTicker(rm.interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            rm.reprovideAll(ctx)
+        }
+    }
+}
+
+// reprovideAll recorre el almacén de fragmentos y reanuncia cada uno en la DHT
+func (rm *ReprovideManager) reprovideAll(ctx context.Context) {
+    hashes := make([]string, 0)
+    rm.node.Store.Iter(func(hash string) bool {
+        hashes = append(hashes, hash)
+        return true
+    })
+
+    log.Printf("Reanunciando %d fragmentos en la DHT", len(hashes))
+    rm.node.provideFragments(ctx, hashes, rm.workers)
+}
+
+// provideFragment anuncia en la DHT que este nodo aloja el fragmento hash
+func (n *P2PNode) provideFragment(ctx context.Context, hash string) error {
+    fcid, err := fragmentCID(hash)
+    if err != nil {
+        return err
+    }
+    if err := n.DHT.Provide(ctx, fcid, true); err != nil {
+        return fmt.Errorf("error anunciando fragmento %s: %v", hash, err)
+    }
+    return nil
+}
+
+// provideFragments anuncia una lista de fragmentos en la DHT usando un pool
+// acotado de workers, para que un archivo con miles de fragmentos no sature la DHT
+func (n *P2PNode) provideFragments(ctx context.Context, hashes []string, workers int) {
+    if workers <= 0 {
+        workers = defaultProvideWorkers
+    }
+
+    sem := make(chan struct{}, workers)
+    var wg sync.WaitGroup
+    for _, hash := range hashes {
+        wg.Add(1)
+        sem <- struct{}{}
+        go func(hash string) {
+            defer wg.Done()
+            defer func() { <-sem }()
+            if err := n.provideFragment(ctx, hash); err != nil {
+                log.Printf("Error anunciando fragmento %s: %v", hash, err)
+            }
+        }(hash)
+    }
+    wg.Wait()
+}
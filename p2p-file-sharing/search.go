@@ -0,0 +1,250 @@
+//search.go
+
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+
+    pubsub "github.com/libp2p/go-libp2p-pubsub"
+    "github.com/libp2p/go-libp2p/core/network"
+    "github.com/libp2p/go-libp2p/core/peer"
+    "github.com/bits-and-blooms/bloom/v3"
+    "golang.org/x/time/rate"
+)
+
+const (
+    searchTopicName      = "/basicp2p/search/1.0.0"
+    searchReplyProtocol  = "/search-reply/1.0.0"
+    searchRateBurst      = 5
+    searchSeenFilterSize = 100000
+    searchSeenFilterFP   = 0.01
+)
+
+// SearchQuery se publica en el topic de búsqueda para preguntar al resto de la
+// red por archivos cuyo nombre contenga Substring
+type SearchQuery struct {
+    QueryID   string
+    Substring string
+}
+
+// SearchResponse es la respuesta a una SearchQuery con los archivos que el
+// nodo que responde tiene y cuyo nombre coincide
+type SearchResponse struct {
+    QueryID string
+    Files   []FileInfo
+}
+
+// SearchManager implementa el descubrimiento de archivos sobre un topic
+// gossipsub: publica consultas, contesta las que recibe y entrega las
+// respuestas a quien esté esperando esa búsqueda
+type SearchManager struct {
+    node  *P2PNode
+    topic *pubsub.Topic
+    sub   *pubsub.Subscription
+
+    mu       sync.Mutex
+    pending  map[string]chan SearchResponse // QueryID -> canal de respuestas entrantes
+    seen     *bloom.BloomFilter             // QueryIDs ya procesados, evita responder una consulta más de una vez
+    limiters map[peer.ID]*rate.Limiter      // límite de consultas por peer origen, para frenar la amplificación
+}
+
+// NewSearchManager une el nodo al topic de búsqueda y lanza el bucle que atiende consultas entrantes
+func NewSearchManager(ctx context.Context, node *P2PNode) (*SearchManager, error) {
+    ps, err := pubsub.NewGossipSub(ctx, node.Host)
+    if err != nil {
+        return nil, fmt.Errorf("error creando gossipsub: %v", err)
+    }
+
+    topic, err := ps.Join(searchTopicName)
+    if err != nil {
+        return nil, fmt.Errorf("error uniéndose al topic de búsqueda: %v", err)
+    }
+
+    sub, err := topic.Subscribe()
+    if err != nil {
+        return nil, fmt.Errorf("error suscribiéndose al topic de búsqueda: %v", err)
+    }
+
+    sm := &SearchManager{
+        node:     node,
+        topic:    topic,
+        sub:      sub,
+        pending:  make(map[string]chan SearchResponse),
+        seen:     bloom.NewWithEstimates(searchSeenFilterSize, searchSeenFilterFP),
+        limiters: make(map[peer.ID]*rate.Limiter),
+    }
+
+    node.Host.SetStreamHandler(searchReplyProtocol, sm.handleSearchReply)
+    go sm.readLoop(ctx)
+
+    return sm, nil
+}
+
+// readLoop procesa las SearchQuery que llegan por el topic de búsqueda
+func (sm *SearchManager) readLoop(ctx context.Context) {
+    for {
+        msg, err := sm.sub.Next(ctx)
+        if err != nil {
+            if ctx.Err() != nil {
+                return
+            }
+            log.Printf("Error leyendo mensaje del topic de búsqueda: %v", err)
+            continue
+        }
+        if msg.ReceivedFrom == sm.node.Host.ID() {
+            continue
+        }
+
+        var query SearchQuery
+        if err := json.Unmarshal(msg.Data, &query); err != nil {
+            log.Printf("Error decodificando consulta de búsqueda: %v", err)
+            continue
+        }
+        sm.handleQuery(ctx, msg.GetFrom(), query)
+    }
+}
+
+// handleQuery responde a una consulta recibida si no se ha visto antes, el
+// peer origen no ha superado su límite de tasa, y este nodo tiene coincidencias
+func (sm *SearchManager) handleQuery(ctx context.Context, from peer.ID, query SearchQuery) {
+    if query.QueryID == "" || query.Substring == "" {
+        return
+    }
+    if !sm.allow(from) {
+        return
+    }
+    if sm.alreadySeen(query.QueryID) {
+        return
+    }
+
+    matches := sm.node.matchingFiles(query.Substring)
+    if len(matches) == 0 {
+        return
+    }
+
+    s, err := sm.node.Host.NewStream(ctx, from, searchReplyProtocol)
+    if err != nil {
+        log.Printf("Error abriendo stream de respuesta de búsqueda con %s: %v", from, err)
+        return
+    }
+    defer s.Close()
+
+    resp := SearchResponse{QueryID: query.QueryID, Files: matches}
+    if err := json.NewEncoder(s).Encode(resp); err != nil {
+        log.Printf("Error enviando respuesta de búsqueda: %v", err)
+    }
+}
+
+// handleSearchReply recibe una SearchResponse por un stream directo y la
+// entrega a quien esté esperando esa QueryID
+func (sm *SearchManager) handleSearchReply(s network.Stream) {
+    defer s.Close()
+
+    var resp SearchResponse
+    if err := json.NewDecoder(s).Decode(&resp); err != nil {
+        log.Printf("Error decodificando respuesta de búsqueda: %v", err)
+        return
+    }
+
+    sm.mu.Lock()
+    ch, ok := sm.pending[resp.QueryID]
+    sm.mu.Unlock()
+    if !ok {
+        return
+    }
+
+    select {
+    case ch <- resp:
+    default:
+    }
+}
+
+// allow aplica un límite de tasa por peer origen para frenar la amplificación de consultas
+func (sm *SearchManager) allow(p peer.ID) bool {
+    sm.mu.Lock()
+    limiter, ok := sm.limiters[p]
+    if !ok {
+        limiter = rate.NewLimiter(rate.Limit(1), searchRateBurst) // media de 1 consulta/seg, ráfagas de hasta 5
+        sm.limiters[p] = limiter
+    }
+    sm.mu.Unlock()
+    return limiter.Allow()
+}
+
+// alreadySeen indica si ya se procesó esta QueryID, usando un bloom filter
+// para no tener que recordar cada ID exacto
+func (sm *SearchManager) alreadySeen(queryID string) bool {
+    sm.mu.Lock()
+    defer sm.mu.Unlock()
+
+    key := []byte(queryID)
+    if sm.seen.Test(key) {
+        return true
+    }
+    sm.seen.Add(key)
+    return false
+}
+
+// SearchFiles publica una SearchQuery en el topic de búsqueda y recolecta las
+// SearchResponse que lleguen durante timeout, deduplicando por nombre de archivo
+func (sm *SearchManager) SearchFiles(ctx context.Context, query string, timeout time.Duration) ([]FileInfo, error) {
+    queryID, err := randomQueryID()
+    if err != nil {
+        return nil, fmt.Errorf("error generando ID de consulta: %v", err)
+    }
+
+    resultsCh := make(chan SearchResponse, 16)
+    sm.mu.Lock()
+    sm.pending[queryID] = resultsCh
+    sm.mu.Unlock()
+    defer func() {
+        sm.mu.Lock()
+        delete(sm.pending, queryID)
+        sm.mu.Unlock()
+    }()
+
+    payload, err := json.Marshal(SearchQuery{QueryID: queryID, Substring: query})
+    if err != nil {
+        return nil, fmt.Errorf("error codificando consulta de búsqueda: %v", err)
+    }
+    if err := sm.topic.Publish(ctx, payload); err != nil {
+        return nil, fmt.Errorf("error publicando consulta de búsqueda: %v", err)
+    }
+
+    deadline := time.NewTimer(timeout)
+    defer deadline.Stop()
+
+    seenFiles := make(map[string]bool)
+    var results []FileInfo
+    for {
+        select {
+        case resp := <-resultsCh:
+            for _, info := range resp.Files {
+                if !seenFiles[info.Filename] {
+                    seenFiles[info.Filename] = true
+                    results = append(results, info)
+                }
+            }
+        case <-deadline.C:
+            return results, nil
+        case <-ctx.Done():
+            return results, ctx.Err()
+        }
+    }
+}
+
+// randomQueryID genera un identificador aleatorio para una búsqueda
+func randomQueryID() (string, error) {
+    buf := make([]byte, 16)
+    if _, err := rand.Read(buf); err != nil {
+        return "", fmt.Errorf("error generando ID aleatorio: %v", err)
+    }
+    return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,349 @@
+//store.go
+
+package main
+
+import (
+    "container/list"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sync"
+
+    "golang.org/x/exp/mmap"
+)
+
+// fragmentHashPattern valida que un hash de fragmento sea un digest SHA-256 en
+// hexadecimal, antes de usarlo para construir una ruta de archivo. Sin esta
+// comprobación, un hash malicioso como "../../../etc/passwd" recibido de un
+// peer permitiría leer o escribir fuera de dataDir (path traversal)
+var fragmentHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// validFragmentHash indica si hash tiene la forma esperada de un digest SHA-256 hexadecimal
+func validFragmentHash(hash string) bool {
+    return fragmentHashPattern.MatchString(hash)
+}
+
+// FragmentMeta son los metadatos de un fragmento almacenado, sin los datos en sí
+type FragmentMeta struct {
+    Index          int
+    TotalFragments int
+    Filename       string
+}
+
+// FragmentStore abstrae dónde se guardan los bytes de los fragmentos alojados,
+// para poder sembrar archivos más grandes que la memoria disponible del nodo
+type FragmentStore interface {
+    Put(hash string, data []byte) error
+    Get(hash string) ([]byte, bool, error)
+    Has(hash string) bool
+    Delete(hash string) error
+    Iter(fn func(hash string) bool)
+}
+
+// MemoryFragmentStore guarda los fragmentos en memoria (el comportamiento original)
+type MemoryFragmentStore struct {
+    mu   sync.RWMutex
+    data map[string][]byte
+}
+
+// NewMemoryFragmentStore crea un almacén de fragmentos en memoria
+func NewMemoryFragmentStore() *MemoryFragmentStore {
+    return &MemoryFragmentStore{data: make(map[string][]byte)}
+}
+
+func (s *MemoryFragmentStore) Put(hash string, data []byte) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.data[hash] = data
+    return nil
+}
+
+func (s *MemoryFragmentStore) Get(hash string) ([]byte, bool, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    data, ok := s.data[hash]
+    return data, ok, nil
+}
+
+func (s *MemoryFragmentStore) Has(hash string) bool {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    _, ok := s.data[hash]
+    return ok
+}
+
+func (s *MemoryFragmentStore) Delete(hash string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    delete(s.data, hash)
+    return nil
+}
+
+func (s *MemoryFragmentStore) Iter(fn func(hash string) bool) {
+    s.mu.RLock()
+    hashes := make([]string, 0, len(s.data))
+    for hash := range s.data {
+        hashes = append(hashes, hash)
+    }
+    s.mu.RUnlock()
+
+    for _, hash := range hashes {
+        if !fn(hash) {
+            return
+        }
+    }
+}
+
+// DiskFragmentStore guarda cada fragmento como un archivo independiente bajo
+// <dataDir>/<hash[:2]>/<hash>, para sembrar archivos que no caben en memoria
+type DiskFragmentStore struct {
+    dataDir string
+}
+
+// NewDiskFragmentStore crea un almacén de fragmentos respaldado por disco bajo dataDir
+func NewDiskFragmentStore(dataDir string) *DiskFragmentStore {
+    return &DiskFragmentStore{dataDir: dataDir}
+}
+
+func (s *DiskFragmentStore) pathFor(hash string) string {
+    prefix := hash
+    if len(prefix) > 2 {
+        prefix = hash[:2]
+    }
+    return filepath.Join(s.dataDir, prefix, hash)
+}
+
+func (s *DiskFragmentStore) Put(hash string, data []byte) error {
+    if !validFragmentHash(hash) {
+        return fmt.Errorf("hash de fragmento inválido: %s", hash)
+    }
+    path := s.pathFor(hash)
+    if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+        return fmt.Errorf("error creando directorio para fragmento %s: %v", hash, err)
+    }
+    if err := os.WriteFile(path, data, 0o644); err != nil {
+        return fmt.Errorf("error escribiendo fragmento %s: %v", hash, err)
+    }
+    return nil
+}
+
+func (s *DiskFragmentStore) Get(hash string) ([]byte, bool, error) {
+    if !validFragmentHash(hash) {
+        return nil, false, fmt.Errorf("hash de fragmento inválido: %s", hash)
+    }
+    data, err := os.ReadFile(s.pathFor(hash))
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil, false, nil
+        }
+        return nil, false, fmt.Errorf("error leyendo fragmento %s: %v", hash, err)
+    }
+    return data, true, nil
+}
+
+func (s *DiskFragmentStore) Has(hash string) bool {
+    if !validFragmentHash(hash) {
+        return false
+    }
+    _, err := os.Stat(s.pathFor(hash))
+    return err == nil
+}
+
+func (s *DiskFragmentStore) Delete(hash string) error {
+    if !validFragmentHash(hash) {
+        return fmt.Errorf("hash de fragmento inválido: %s", hash)
+    }
+    if err := os.Remove(s.pathFor(hash)); err != nil && !os.IsNotExist(err) {
+        return fmt.Errorf("error borrando fragmento %s: %v", hash, err)
+    }
+    return nil
+}
+
+func (s *DiskFragmentStore) Iter(fn func(hash string) bool) {
+    entries, err := filepath.Glob(filepath.Join(s.dataDir, "*", "*"))
+    if err != nil {
+        return
+    }
+    for _, path := range entries {
+        if !fn(filepath.Base(path)) {
+            return
+        }
+    }
+}
+
+// MMapFragmentStore guarda cada fragmento en su propio archivo bajo dataDir,
+// igual que DiskFragmentStore, pero lo lee mediante un mapeo en memoria
+// (golang.org/x/exp/mmap) que se mantiene abierto entre lecturas. Get copia el
+// contenido mapeado completo a un slice nuevo en cada llamada; no devuelve
+// vistas sobre el mapeo
+type MMapFragmentStore struct {
+    disk *DiskFragmentStore
+
+    mu      sync.Mutex
+    readers map[string]*mmap.ReaderAt
+}
+
+// NewMMapFragmentStore crea un almacén de fragmentos respaldado por archivos mapeados en memoria bajo dataDir
+func NewMMapFragmentStore(dataDir string) *MMapFragmentStore {
+    return &MMapFragmentStore{
+        disk:    NewDiskFragmentStore(dataDir),
+        readers: make(map[string]*mmap.ReaderAt),
+    }
+}
+
+func (s *MMapFragmentStore) Put(hash string, data []byte) error {
+    s.mu.Lock()
+    if reader, ok := s.readers[hash]; ok {
+        reader.Close()
+        delete(s.readers, hash)
+    }
+    s.mu.Unlock()
+    return s.disk.Put(hash, data)
+}
+
+func (s *MMapFragmentStore) Get(hash string) ([]byte, bool, error) {
+    if !s.disk.Has(hash) {
+        return nil, false, nil
+    }
+
+    s.mu.Lock()
+    reader, ok := s.readers[hash]
+    if !ok {
+        var err error
+        reader, err = mmap.Open(s.disk.pathFor(hash))
+        if err != nil {
+            s.mu.Unlock()
+            return nil, false, fmt.Errorf("error mapeando fragmento %s: %v", hash, err)
+        }
+        s.readers[hash] = reader
+    }
+    s.mu.Unlock()
+
+    data := make([]byte, reader.Len())
+    if _, err := reader.ReadAt(data, 0); err != nil {
+        return nil, false, fmt.Errorf("error leyendo fragmento mapeado %s: %v", hash, err)
+    }
+    return data, true, nil
+}
+
+func (s *MMapFragmentStore) Has(hash string) bool {
+    return s.disk.Has(hash)
+}
+
+func (s *MMapFragmentStore) Delete(hash string) error {
+    s.mu.Lock()
+    if reader, ok := s.readers[hash]; ok {
+        reader.Close()
+        delete(s.readers, hash)
+    }
+    s.mu.Unlock()
+    return s.disk.Delete(hash)
+}
+
+func (s *MMapFragmentStore) Iter(fn func(hash string) bool) {
+    s.disk.Iter(fn)
+}
+
+// LRUFragmentStore envuelve otro FragmentStore (normalmente el de memoria) y
+// acota cuántos fragmentos mantiene, expulsando el usado menos recientemente
+// cuando se supera la capacidad
+type LRUFragmentStore struct {
+    backing  FragmentStore
+    capacity int
+
+    mu    sync.Mutex
+    order *list.List
+    elems map[string]*list.Element
+}
+
+// NewLRUFragmentStore envuelve backing con un límite de capacity fragmentos (0 = sin límite)
+func NewLRUFragmentStore(backing FragmentStore, capacity int) *LRUFragmentStore {
+    return &LRUFragmentStore{
+        backing:  backing,
+        capacity: capacity,
+        order:    list.New(),
+        elems:    make(map[string]*list.Element),
+    }
+}
+
+func (s *LRUFragmentStore) Put(hash string, data []byte) error {
+    if err := s.backing.Put(hash, data); err != nil {
+        return err
+    }
+    s.mu.Lock()
+    s.touch(hash)
+    s.evictIfNeeded()
+    s.mu.Unlock()
+    return nil
+}
+
+func (s *LRUFragmentStore) Get(hash string) ([]byte, bool, error) {
+    data, ok, err := s.backing.Get(hash)
+    if err == nil && ok {
+        s.mu.Lock()
+        s.touch(hash)
+        s.mu.Unlock()
+    }
+    return data, ok, err
+}
+
+func (s *LRUFragmentStore) Has(hash string) bool {
+    return s.backing.Has(hash)
+}
+
+func (s *LRUFragmentStore) Delete(hash string) error {
+    s.mu.Lock()
+    if elem, ok := s.elems[hash]; ok {
+        s.order.Remove(elem)
+        delete(s.elems, hash)
+    }
+    s.mu.Unlock()
+    return s.backing.Delete(hash)
+}
+
+func (s *LRUFragmentStore) Iter(fn func(hash string) bool) {
+    s.backing.Iter(fn)
+}
+
+func (s *LRUFragmentStore) touch(hash string) {
+    if elem, ok := s.elems[hash]; ok {
+        s.order.MoveToFront(elem)
+        return
+    }
+    s.elems[hash] = s.order.PushFront(hash)
+}
+
+func (s *LRUFragmentStore) evictIfNeeded() {
+    for s.capacity > 0 && s.order.Len() > s.capacity {
+        oldest := s.order.Back()
+        if oldest == nil {
+            return
+        }
+        hash := oldest.Value.(string)
+        s.order.Remove(oldest)
+        delete(s.elems, hash)
+        if err := s.backing.Delete(hash); err != nil {
+            log.Printf("Error expulsando fragmento %s del caché LRU: %v", hash, err)
+        }
+    }
+}
+
+// newFragmentStore construye el FragmentStore indicado por la bandera --store
+func newFragmentStore(kind, dataDir string, cacheCapacity int) (FragmentStore, error) {
+    switch kind {
+    case "", "memory":
+        var store FragmentStore = NewMemoryFragmentStore()
+        if cacheCapacity > 0 {
+            store = NewLRUFragmentStore(store, cacheCapacity)
+        }
+        return store, nil
+    case "disk":
+        return NewDiskFragmentStore(dataDir), nil
+    case "mmap":
+        return NewMMapFragmentStore(dataDir), nil
+    default:
+        return nil, fmt.Errorf("backend de almacenamiento desconocido: %s", kind)
+    }
+}
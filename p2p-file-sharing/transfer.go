@@ -0,0 +1,307 @@
+//transfer.go
+
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "log"
+    "math/rand"
+    "sync"
+    "time"
+
+    "github.com/ipfs/go-cid"
+    "github.com/libp2p/go-libp2p/core/peer"
+    mh "github.com/multiformats/go-multihash"
+)
+
+// maxFailuresBeforeBlacklist es el número de fallos consecutivos que provocan
+// que un peer sea descartado para el resto de la transferencia
+const maxFailuresBeforeBlacklist = 3
+
+// ProgressEvent reporta el avance de una descarga
+type ProgressEvent struct {
+    Filename       string
+    FragmentsTotal int
+    FragmentsDone  int
+    BytesDone      int64
+}
+
+// TransferManager coordina la descarga concurrente de los fragmentos de un archivo
+type TransferManager struct {
+    node        *P2PNode
+    parallelism int
+
+    mu          sync.Mutex
+    inFlight    map[string]*fragmentFetch    // raíz de Merkle + ":" + hash -> descarga en curso (dedupe entre descargas simultáneas con la misma raíz, incluso entre transferKey distintos)
+    failures    map[string]map[peer.ID]int   // transferKey -> peer -> fallos consecutivos
+    blacklist   map[string]map[peer.ID]bool  // transferKey -> peers descartados para esta transferencia
+    transferSeq uint64                       // contador para derivar un transferKey único por llamada a FetchFile
+}
+
+// fragmentFetch representa una descarga de fragmento en curso que varios
+// consumidores pueden esperar sin duplicar la solicitud de red
+type fragmentFetch struct {
+    done chan struct{}
+    data []byte
+    err  error
+}
+
+// NewTransferManager crea un gestor de transferencias con el paralelismo indicado
+func NewTransferManager(node *P2PNode, parallelism int) *TransferManager {
+    if parallelism <= 0 {
+        parallelism = 4
+    }
+    return &TransferManager{
+        node:        node,
+        parallelism: parallelism,
+        inFlight:    make(map[string]*fragmentFetch),
+        failures:    make(map[string]map[peer.ID]int),
+        blacklist:   make(map[string]map[peer.ID]bool),
+    }
+}
+
+// fragmentCID deriva el CID usado para anunciar/localizar un fragmento en la DHT
+// a partir de su hash SHA-256 en hexadecimal
+func fragmentCID(hash string) (cid.Cid, error) {
+    digest, err := hex.DecodeString(hash)
+    if err != nil {
+        return cid.Undef, fmt.Errorf("hash de fragmento inválido: %v", err)
+    }
+    encoded, err := mh.Encode(digest, mh.SHA2_256)
+    if err != nil {
+        return cid.Undef, fmt.Errorf("error codificando multihash: %v", err)
+    }
+    return cid.NewCidV1(cid.Raw, encoded), nil
+}
+
+// FetchFile descarga todos los fragmentos de info.FragmentHashes en paralelo.
+// progressCh es opcional; si no es nil se le envía un ProgressEvent por cada fragmento
+// completado sin bloquear, de modo que el evento se descarta si el canal está lleno.
+func (tm *TransferManager) FetchFile(ctx context.Context, info FileInfo, progressCh chan<- ProgressEvent) ([]Fragment, error) {
+    // TransferManager vive más que una sola descarga, pero los fallos y el
+    // blacklist de peers son por transferencia: usar una clave única por
+    // llamada, en vez de info.Filename, evita que dos descargas concurrentes
+    // del mismo archivo se pisen el blacklist entre sí, y borrarla al
+    // terminar evita que failures/blacklist crezcan sin límite mientras dure el nodo
+    transferKey := tm.newTransferKey(info.Filename)
+    defer tm.clearTransfer(transferKey)
+
+    results := make([]Fragment, info.TotalFragments)
+    errCh := make(chan error, info.TotalFragments)
+    sem := make(chan struct{}, tm.parallelism)
+
+    var wg sync.WaitGroup
+    var mu sync.Mutex
+    var fragmentsDone int
+    var bytesDone int64
+
+    for i, hash := range info.FragmentHashes {
+        wg.Add(1)
+        sem <- struct{}{}
+        go func(index int, hash string) {
+            defer wg.Done()
+            defer func() { <-sem }()
+
+            data, err := tm.fetchFragment(ctx, transferKey, hash, index, info.TotalFragments, info.MerkleRoot)
+            if err != nil {
+                errCh <- fmt.Errorf("error obteniendo fragmento %s: %v", hash, err)
+                return
+            }
+
+            results[index] = Fragment{
+                Hash:           hash,
+                Data:           data,
+                Index:          index,
+                TotalFragments: info.TotalFragments,
+                Filename:       info.Filename,
+            }
+
+            mu.Lock()
+            fragmentsDone++
+            bytesDone += int64(len(data))
+            done, bytes := fragmentsDone, bytesDone
+            mu.Unlock()
+
+            if progressCh != nil {
+                select {
+                case progressCh <- ProgressEvent{
+                    Filename:       info.Filename,
+                    FragmentsTotal: info.TotalFragments,
+                    FragmentsDone:  done,
+                    BytesDone:      bytes,
+                }:
+                default:
+                }
+            }
+        }(i, hash)
+    }
+
+    wg.Wait()
+    close(errCh)
+
+    if err, ok := <-errCh; ok {
+        return nil, err
+    }
+    return results, nil
+}
+
+// fetchFragment obtiene un fragmento reusando una solicitud en curso si ya existe,
+// de forma que varias descargas simultáneas que necesitan el mismo hash con la
+// misma raíz de Merkle comparten un único stream; descargas de archivos con
+// raíces distintas piden el mismo hash por separado
+func (tm *TransferManager) fetchFragment(ctx context.Context, transferKey, hash string, index, total int, root string) ([]byte, error) {
+    key := root + ":" + hash
+
+    tm.mu.Lock()
+    if fetch, ok := tm.inFlight[key]; ok {
+        tm.mu.Unlock()
+        <-fetch.done
+        return fetch.data, fetch.err
+    }
+    fetch := &fragmentFetch{done: make(chan struct{})}
+    tm.inFlight[key] = fetch
+    tm.mu.Unlock()
+
+    fetch.data, fetch.err = tm.fetchFragmentFromNetwork(ctx, transferKey, hash, index, total, root)
+    close(fetch.done)
+
+    tm.mu.Lock()
+    delete(tm.inFlight, key)
+    tm.mu.Unlock()
+
+    return fetch.data, fetch.err
+}
+
+// fetchFragmentFromNetwork localiza proveedores del fragmento vía la DHT y va
+// probándolos uno a uno, con reintentos con backoff exponencial y descartando
+// a los peers que fallan repetidamente dentro de esta transferencia
+func (tm *TransferManager) fetchFragmentFromNetwork(ctx context.Context, transferKey, hash string, index, total int, root string) ([]byte, error) {
+    fcid, err := fragmentCID(hash)
+    if err != nil {
+        return nil, err
+    }
+
+    providers := tm.node.DHT.FindProvidersAsync(ctx, fcid, 20)
+
+    var lastErr error
+    attempt := 0
+    for provider := range providers {
+        if tm.isBlacklisted(transferKey, provider.ID) {
+            continue
+        }
+
+        data, err := tm.requestFragmentFromPeer(ctx, provider.ID, hash, index, total, root)
+        if err == nil {
+            tm.mu.Lock()
+            delete(tm.failures[transferKey], provider.ID)
+            tm.mu.Unlock()
+            return data, nil
+        }
+
+        lastErr = err
+        log.Printf("Error obteniendo fragmento %s de %s: %v", hash, provider.ID, err)
+        tm.markFailure(transferKey, provider.ID)
+
+        attempt++
+        time.Sleep(backoffDuration(attempt))
+    }
+
+    if lastErr == nil {
+        lastErr = fmt.Errorf("no se encontraron proveedores para el fragmento %s", hash)
+    }
+    return nil, lastErr
+}
+
+// requestFragmentFromPeer abre un stream /fragment/1.0.0 con el peer indicado,
+// comprueba que los datos recibidos corresponden al hash solicitado y, si el
+// archivo tiene raíz de Merkle, verifica la prueba de inclusión antes de aceptarlo
+func (tm *TransferManager) requestFragmentFromPeer(ctx context.Context, p peer.ID, hash string, index, total int, root string) ([]byte, error) {
+    s, err := tm.node.Host.NewStream(ctx, p, "/fragment/1.0.0")
+    if err != nil {
+        return nil, fmt.Errorf("error abriendo stream con %s: %v", p, err)
+    }
+    defer s.Close()
+
+    if err := json.NewEncoder(s).Encode(FragmentRequest{Hash: hash}); err != nil {
+        return nil, fmt.Errorf("error enviando solicitud: %v", err)
+    }
+
+    var resp FragmentResponse
+    if err := json.NewDecoder(s).Decode(&resp); err != nil {
+        return nil, fmt.Errorf("error leyendo respuesta: %v", err)
+    }
+    if !resp.Found {
+        return nil, fmt.Errorf("peer %s no tiene el fragmento %s", p, hash)
+    }
+    if got := fmt.Sprintf("%x", sha256.Sum256(resp.Data)); got != hash {
+        return nil, fmt.Errorf("fragmento %s corrupto recibido de %s", hash, p)
+    }
+    if root != "" {
+        if err := tm.node.FragmentMgr.VerifyFragment(resp.Data, index, total, resp.Proof, root); err != nil {
+            return nil, fmt.Errorf("prueba de Merkle inválida recibida de %s: %v", p, err)
+        }
+    }
+    return resp.Data, nil
+}
+
+// markFailure registra un fallo del peer para esta transferencia y lo
+// descarta si acumula demasiados fallos consecutivos
+func (tm *TransferManager) markFailure(transferKey string, p peer.ID) {
+    tm.mu.Lock()
+    defer tm.mu.Unlock()
+
+    if tm.failures[transferKey] == nil {
+        tm.failures[transferKey] = make(map[peer.ID]int)
+    }
+    tm.failures[transferKey][p]++
+
+    if tm.failures[transferKey][p] >= maxFailuresBeforeBlacklist {
+        if tm.blacklist[transferKey] == nil {
+            tm.blacklist[transferKey] = make(map[peer.ID]bool)
+        }
+        tm.blacklist[transferKey][p] = true
+        log.Printf("Peer %s descartado para esta transferencia tras %d fallos", p, tm.failures[transferKey][p])
+    }
+}
+
+// isBlacklisted indica si el peer fue descartado para esta transferencia
+func (tm *TransferManager) isBlacklisted(transferKey string, p peer.ID) bool {
+    tm.mu.Lock()
+    defer tm.mu.Unlock()
+    return tm.blacklist[transferKey][p]
+}
+
+// newTransferKey deriva una clave única para una llamada a FetchFile a partir
+// de filename, de forma que dos descargas concurrentes del mismo archivo no
+// compartan failures/blacklist y se pisen el backoff entre sí
+func (tm *TransferManager) newTransferKey(filename string) string {
+    tm.mu.Lock()
+    tm.transferSeq++
+    seq := tm.transferSeq
+    tm.mu.Unlock()
+    return fmt.Sprintf("%s#%d", filename, seq)
+}
+
+// clearTransfer borra los fallos y el blacklist acumulados para transferKey
+// al terminar su FetchFile, para que no se acumulen sin límite mientras dure
+// el nodo ahora que TransferManager ya no se recrea en cada descarga
+func (tm *TransferManager) clearTransfer(transferKey string) {
+    tm.mu.Lock()
+    defer tm.mu.Unlock()
+    delete(tm.failures, transferKey)
+    delete(tm.blacklist, transferKey)
+}
+
+// backoffDuration calcula una espera exponencial con jitter antes de probar el siguiente peer
+func backoffDuration(attempt int) time.Duration {
+    d := time.Duration(1<<uint(attempt)) * 100 * time.Millisecond
+    if d > 10*time.Second {
+        d = 10 * time.Second
+    }
+    jitter := time.Duration(rand.Int63n(int64(d/2 + 1)))
+    return d + jitter
+}